@@ -0,0 +1,223 @@
+package workloads
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"mime/multipart"
+)
+
+// BitsResource describes one file included in an app bits upload.
+type BitsResource struct {
+	Fn   string `json:"fn"`
+	Sha1 string `json:"sha1,omitempty"`
+	Size int64  `json:"size"`
+}
+
+// BitsSource supplies the payload for UploadBits: a manifest describing
+// each resource, and a way to open its content on demand so a large
+// payload never has to be buffered in memory to be streamed.
+type BitsSource interface {
+	Manifest() []BitsResource
+	Open(path string) (io.ReadCloser, int64, error)
+}
+
+func (context *context) UploadBits(appURI string, src BitsSource) error {
+	contentType, contentLength, body, err := buildMultipartBody(src)
+	if err != nil {
+		return err
+	}
+
+	return context.MultipartPutSuccessfully(appURI+"/bits", contentType, contentLength, body, nil, func(reply Reply) error {
+		return nil
+	})
+}
+
+// buildMultipartBody returns the content type, exact Content-Length and a
+// streaming io.Reader for a multipart/form-data body carrying src's
+// resources manifest and file contents. The length is computed up front
+// from the resources' sizes so the request can be streamed via io.Pipe
+// without ever buffering the whole body in memory.
+func buildMultipartBody(src BitsSource) (string, int64, io.Reader, error) {
+	manifest := src.Manifest()
+
+	boundary, err := randomBoundary()
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	overhead, err := multipartOverhead(boundary, manifest)
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	contentLength := overhead
+	for _, resource := range manifest {
+		contentLength += resource.Size
+	}
+
+	pr, pw := io.Pipe()
+	go streamMultipartBody(pw, boundary, src, manifest)
+
+	return "multipart/form-data; boundary=" + boundary, contentLength, pr, nil
+}
+
+// multipartOverhead measures the exact number of bytes a multipart.Writer
+// using boundary would emit for the resources field and every part's
+// boundary/header, excluding the file contents themselves (which pass
+// through unencoded and so just add resource.Size bytes each).
+func multipartOverhead(boundary string, manifest []BitsResource) (int64, error) {
+	counter := &byteCounter{}
+	m := multipart.NewWriter(counter)
+	if err := m.SetBoundary(boundary); err != nil {
+		return 0, err
+	}
+
+	resourcesJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return 0, err
+	}
+	if err := m.WriteField("resources", string(resourcesJSON)); err != nil {
+		return 0, err
+	}
+
+	for _, resource := range manifest {
+		if _, err := m.CreateFormFile("application", resource.Fn); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := m.Close(); err != nil {
+		return 0, err
+	}
+
+	return counter.n, nil
+}
+
+func streamMultipartBody(pw *io.PipeWriter, boundary string, src BitsSource, manifest []BitsResource) {
+	m := multipart.NewWriter(pw)
+	if err := m.SetBoundary(boundary); err != nil {
+		pw.CloseWithError(err)
+		return
+	}
+
+	resourcesJSON, err := json.Marshal(manifest)
+	if err != nil {
+		pw.CloseWithError(err)
+		return
+	}
+	if err := m.WriteField("resources", string(resourcesJSON)); err != nil {
+		pw.CloseWithError(err)
+		return
+	}
+
+	for _, resource := range manifest {
+		part, err := m.CreateFormFile("application", resource.Fn)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		content, _, err := src.Open(resource.Fn)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		_, err = io.Copy(part, content)
+		content.Close()
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+	}
+
+	if err := m.Close(); err != nil {
+		pw.CloseWithError(err)
+		return
+	}
+
+	pw.Close()
+}
+
+type byteCounter struct {
+	n int64
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+func randomBoundary() (string, error) {
+	var buf [30]byte
+	if _, err := io.ReadFull(rand.Reader, buf[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", buf), nil
+}
+
+// ZipBitsSource is a BitsSource that synthesizes a single app bits payload
+// of the configured size, rather than reading a real app's files, so pat
+// can generate realistic upload load without needing an app on disk. The
+// Compressibility fraction (0 fully random, 1 fully zeroed) lets a test
+// tune how much the payload resembles a compressible zip.
+type ZipBitsSource struct {
+	Size            int64
+	Compressibility float64
+}
+
+const zipBitsFilename = "app.zip"
+
+func (z ZipBitsSource) Manifest() []BitsResource {
+	return []BitsResource{{Fn: zipBitsFilename, Size: z.Size}}
+}
+
+func (z ZipBitsSource) Open(path string) (io.ReadCloser, int64, error) {
+	if path != zipBitsFilename {
+		return nil, 0, fmt.Errorf("unknown resource: %s", path)
+	}
+
+	return io.NopCloser(newCompressibleReader(z.Size, z.Compressibility)), z.Size, nil
+}
+
+// compressibleReader streams exactly Size bytes, choosing per chunk between
+// a run of zeroes and math/rand output so the overall payload's
+// compressibility ratio tends towards Compressibility as Size grows.
+type compressibleReader struct {
+	remaining       int64
+	compressibility float64
+	rnd             *mathrand.Rand
+}
+
+func newCompressibleReader(size int64, compressibility float64) io.Reader {
+	return &compressibleReader{
+		remaining:       size,
+		compressibility: compressibility,
+		rnd:             mathrand.New(mathrand.NewSource(size)),
+	}
+}
+
+func (r *compressibleReader) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		return 0, io.EOF
+	}
+
+	n := int64(len(p))
+	if n > r.remaining {
+		n = r.remaining
+	}
+
+	if r.rnd.Float64() < r.compressibility {
+		for i := int64(0); i < n; i++ {
+			p[i] = 0
+		}
+	} else {
+		r.rnd.Read(p[:n])
+	}
+
+	r.remaining -= n
+	return int(n), nil
+}
@@ -0,0 +1,46 @@
+package workloads
+
+import (
+	"io"
+	"io/ioutil"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ZipBitsSource", func() {
+	It("Reports a manifest matching the configured size", func() {
+		src := ZipBitsSource{Size: 1024, Compressibility: 0.5}
+		manifest := src.Manifest()
+		Ω(manifest).Should(HaveLen(1))
+		Ω(manifest[0].Size).Should(Equal(int64(1024)))
+	})
+
+	It("Opens exactly Size bytes of content", func() {
+		src := ZipBitsSource{Size: 2048, Compressibility: 0.25}
+		manifest := src.Manifest()
+
+		r, size, err := src.Open(manifest[0].Fn)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(size).Should(Equal(int64(2048)))
+		defer r.Close()
+
+		data, err := ioutil.ReadAll(r)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(data).Should(HaveLen(2048))
+	})
+})
+
+var _ = Describe("buildMultipartBody", func() {
+	It("Computes a Content-Length that matches the streamed body", func() {
+		src := ZipBitsSource{Size: 4096, Compressibility: 0.5}
+
+		contentType, contentLength, body, err := buildMultipartBody(src)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(contentType).Should(ContainSubstring("multipart/form-data"))
+
+		streamed, err := io.Copy(ioutil.Discard, body)
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(streamed).Should(Equal(contentLength))
+	})
+})
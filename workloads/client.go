@@ -1,17 +1,20 @@
 package workloads
 
 import (
+	stdcontext "context"
 	"encoding/json"
-	"mime/multipart"
+	"io"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
 	"strings"
+	"time"
 )
 
 type httpclient interface {
 	Get(url string, data interface{}, responseBody interface{}) (reply Reply)
 	Put(url string, data interface{}, responseBody interface{}) (reply Reply)
-	MultipartPut(m *multipart.Writer, url string, data interface{}, responseBody interface{}) (reply Reply)
+	MultipartPut(url string, contentType string, contentLength int64, body io.Reader, responseBody interface{}) (reply Reply)
 	Post(url string, data interface{}, responseBody interface{}) (reply Reply)
 	PostToUaa(url string, data url.Values, responseBody interface{}) (reply Reply)
 }
@@ -20,6 +23,7 @@ type Reply struct {
 	Code     int
 	Message  string
 	Location string
+	Timings  Timings
 }
 
 func (client context) Post(url string, data interface{}, body interface{}) Reply {
@@ -30,8 +34,8 @@ func (client context) Put(url string, data interface{}, body interface{}) Reply
 	return client.req("PUT", url, "", "bearer", client.token, jsonToString(data), body)
 }
 
-func (client context) MultipartPut(m *multipart.Writer, url string, data interface{}, body interface{}) Reply {
-	return client.req("PUT", url, m.FormDataContentType(), "bearer", client.token, jsonToString(data), body)
+func (client context) MultipartPut(url string, contentType string, contentLength int64, body io.Reader, responseBody interface{}) Reply {
+	return client.reqBody("PUT", url, contentType, "bearer", client.token, body, contentLength, responseBody)
 }
 
 func (client context) Get(url string, data interface{}, body interface{}) Reply {
@@ -43,6 +47,9 @@ func (client context) PostToUaa(url string, data url.Values, reply interface{})
 }
 
 func (context *context) GetSuccessfully(url string, data url.Values, responseBody interface{}, fn func(reply Reply) error) error {
+	if err := context.refreshTokenIfNeeded(); err != nil {
+		return err
+	}
 	reply := context.client.Get(url, data, responseBody)
 	return checkSuccessfulReply(reply, func() error {
 		return fn(reply)
@@ -50,20 +57,29 @@ func (context *context) GetSuccessfully(url string, data url.Values, responseBod
 }
 
 func (context *context) PutSuccessfully(url string, data interface{}, responseBody interface{}, fn func(reply Reply) error) error {
+	if err := context.refreshTokenIfNeeded(); err != nil {
+		return err
+	}
 	reply := context.client.Put(url, data, responseBody)
 	return checkSuccessfulReply(reply, func() error {
 		return fn(reply)
 	})
 }
 
-func (context *context) MultipartPutSuccessfully(m *multipart.Writer, url string, data interface{}, responseBody interface{}, fn func(reply Reply) error) error {
-	reply := context.client.MultipartPut(m, url, data, responseBody)
+func (context *context) MultipartPutSuccessfully(url string, contentType string, contentLength int64, body io.Reader, responseBody interface{}, fn func(reply Reply) error) error {
+	if err := context.refreshTokenIfNeeded(); err != nil {
+		return err
+	}
+	reply := context.client.MultipartPut(url, contentType, contentLength, body, responseBody)
 	return checkSuccessfulReply(reply, func() error {
 		return fn(reply)
 	})
 }
 
 func (context *context) PostSuccessfully(url string, data interface{}, responseBody interface{}, fn func(reply Reply) error) error {
+	if err := context.refreshTokenIfNeeded(); err != nil {
+		return err
+	}
 	reply := context.client.Post(url, data, responseBody)
 	return checkSuccessfulReply(reply, func() error {
 		return fn(reply)
@@ -83,10 +99,38 @@ func jsonToString(data interface{}) string {
 }
 
 func (client context) req(method string, url string, contentType string, authUser string, authPassword string, data string, reply interface{}) Reply {
-	req, err := http.NewRequest(method, url, strings.NewReader(data))
+	return client.reqBody(method, url, contentType, authUser, authPassword, strings.NewReader(data), int64(len(data)), reply)
+}
+
+func (client context) reqBody(method string, url string, contentType string, authUser string, authPassword string, body io.Reader, contentLength int64, reply interface{}) Reply {
+	ctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	defer cancel()
+
+	var deadline *deadlineTimer
+	if client.requestTimeout > 0 {
+		deadline = &deadlineTimer{}
+		deadline.init()
+		deadline.SetRequestTimeout(client.requestTimeout)
+		defer deadline.Stop()
+
+		go func() {
+			select {
+			case <-deadline.deadlineCh():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	start := time.Now()
+	var timings Timings
+	ctx = httptrace.WithClientTrace(ctx, newClientTrace(start, &timings))
+
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
 	if err != nil {
-		return Reply{0, err.Error(), ""}
+		return Reply{Code: 0, Message: err.Error()}
 	}
+	req.ContentLength = contentLength
 
 	if authUser != "" {
 		req.SetBasicAuth(authUser, authPassword)
@@ -96,12 +140,27 @@ func (client context) req(method string, url string, contentType string, authUse
 		req.Header.Set("Content-Type", contentType)
 	}
 
-	c := &http.Client{}
+	c := &http.Client{Transport: client.transport}
 	resp, err := c.Do(req)
 	if err != nil {
-		return Reply{0, err.Error(), ""}
+		if deadline != nil && ctx.Err() == stdcontext.Canceled {
+			return Reply{Code: 0, Message: "timeout"}
+		}
+		return Reply{Code: 0, Message: err.Error()}
 	}
+	defer resp.Body.Close()
 
 	err = json.NewDecoder(resp.Body).Decode(&reply)
-	return Reply{resp.StatusCode, resp.Status, resp.Header.Get("Location")}
+	timings.Total = time.Since(start)
+
+	if MetricsSink != nil {
+		MetricsSink(timings.Metrics())
+	}
+
+	return Reply{
+		Code:     resp.StatusCode,
+		Message:  resp.Status,
+		Location: resp.Header.Get("Location"),
+		Timings:  timings,
+	}
 }
@@ -0,0 +1,190 @@
+package workloads
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("req", func() {
+	var server *httptest.Server
+
+	AfterEach(func() {
+		if server != nil {
+			server.Close()
+		}
+	})
+
+	Context("When the request exceeds the configured timeout", func() {
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(100 * time.Millisecond)
+				w.Write([]byte("{}"))
+			}))
+		})
+
+		It("Returns a timeout Reply instead of blocking forever", func() {
+			client := context{requestTimeout: 10 * time.Millisecond}
+
+			var body interface{}
+			reply := client.Get(server.URL, nil, &body)
+			Ω(reply.Code).Should(Equal(0))
+			Ω(reply.Message).Should(Equal("timeout"))
+		})
+	})
+
+	Context("When the request completes within the timeout", func() {
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("{}"))
+			}))
+		})
+
+		It("Returns the real reply", func() {
+			client := context{requestTimeout: time.Second}
+
+			var body interface{}
+			reply := client.Get(server.URL, nil, &body)
+			Ω(reply.Code).Should(Equal(200))
+		})
+	})
+
+	Context("When two requests with their own deadlines run concurrently", func() {
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(50 * time.Millisecond)
+				w.Write([]byte("{}"))
+			}))
+		})
+
+		It("Times out independently of each other", func() {
+			fast := context{requestTimeout: 10 * time.Millisecond}
+			slow := context{requestTimeout: time.Second}
+
+			done := make(chan Reply, 2)
+			go func() {
+				var body interface{}
+				done <- fast.Get(server.URL, nil, &body)
+			}()
+			go func() {
+				var body interface{}
+				done <- slow.Get(server.URL, nil, &body)
+			}()
+
+			first := <-done
+			second := <-done
+			codes := []int{first.Code, second.Code}
+			messages := []string{first.Message, second.Message}
+			Ω(codes).Should(ContainElement(0))
+			Ω(messages).Should(ContainElement("timeout"))
+			Ω(codes).Should(ContainElement(200))
+		})
+	})
+
+	Context("Timing a successful call", func() {
+		BeforeEach(func() {
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(10 * time.Millisecond)
+				w.Write([]byte("{}"))
+			}))
+		})
+
+		It("Records TTFB and the overall duration of the call", func() {
+			client := context{}
+
+			var body interface{}
+			reply := client.Get(server.URL, nil, &body)
+			Ω(reply.Code).Should(Equal(200))
+			Ω(reply.Timings.TTFB).Should(BeNumerically(">", 0))
+			Ω(reply.Timings.Total).Should(BeNumerically(">=", reply.Timings.TTFB))
+		})
+
+		It("Publishes the call's Timings to MetricsSink, when one is set", func() {
+			var published map[string]float64
+			MetricsSink = func(m map[string]float64) { published = m }
+			defer func() { MetricsSink = nil }()
+
+			client := context{}
+
+			var body interface{}
+			client.Get(server.URL, nil, &body)
+			Ω(published).Should(HaveKey("total_ms"))
+			Ω(published["total_ms"]).Should(BeNumerically(">", 0))
+		})
+	})
+
+	Context("Converting Timings to metric samples", func() {
+		It("Renders each phase in milliseconds", func() {
+			timings := Timings{
+				DNS:     1 * time.Millisecond,
+				Connect: 2 * time.Millisecond,
+				TLS:     3 * time.Millisecond,
+				TTFB:    6 * time.Millisecond,
+				Total:   10 * time.Millisecond,
+			}
+
+			Ω(timings.Metrics()).Should(Equal(map[string]float64{
+				"dns_ms":     1,
+				"connect_ms": 2,
+				"tls_ms":     3,
+				"ttfb_ms":    6,
+				"total_ms":   10,
+			}))
+		})
+	})
+
+	Context("Recording phase timings in the order the trace hooks fire", func() {
+		It("Records DNS and connect before TTFB", func() {
+			var events []string
+			client := context{transport: &tracePhaseRoundTripper{events: &events}}
+
+			var body interface{}
+			reply := client.Get("http://example.com", nil, &body)
+
+			Ω(reply.Code).Should(Equal(200))
+			Ω(events).Should(Equal([]string{"dns-done", "connect-done", "ttfb"}))
+			Ω(reply.Timings.DNS).Should(BeNumerically(">", 0))
+			Ω(reply.Timings.Connect).Should(BeNumerically(">", 0))
+			Ω(reply.Timings.TTFB).Should(BeNumerically(">=", reply.Timings.DNS+reply.Timings.Connect))
+		})
+	})
+})
+
+// tracePhaseRoundTripper is a fake http.RoundTripper that drives the
+// httptrace.ClientTrace attached to the request's context through a fixed
+// DNS -> connect -> TTFB sequence, with a small sleep per phase, so the test
+// can assert both the firing order and that each phase's duration landed in
+// the right Timings field.
+type tracePhaseRoundTripper struct {
+	events *[]string
+}
+
+func (rt *tracePhaseRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	trace := httptrace.ContextClientTrace(req.Context())
+
+	trace.DNSStart(httptrace.DNSStartInfo{})
+	time.Sleep(5 * time.Millisecond)
+	trace.DNSDone(httptrace.DNSDoneInfo{})
+	*rt.events = append(*rt.events, "dns-done")
+
+	trace.ConnectStart("tcp", "example.com:80")
+	time.Sleep(5 * time.Millisecond)
+	trace.ConnectDone("tcp", "example.com:80", nil)
+	*rt.events = append(*rt.events, "connect-done")
+
+	trace.GotFirstResponseByte()
+	*rt.events = append(*rt.events, "ttfb")
+
+	return &http.Response{
+		StatusCode: 200,
+		Status:     "200 OK",
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader("{}")),
+	}, nil
+}
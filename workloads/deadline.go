@@ -0,0 +1,82 @@
+package workloads
+
+import (
+	"sync"
+	"time"
+)
+
+// deadlineTimer mirrors the pattern used by golang.org/x/net/nettest-style
+// gonet connections: a read and a write deadline, each backed by a timer and
+// a cancel channel that is closed when the deadline fires. Callers select on
+// the relevant channel to learn that their operation should give up.
+type deadlineTimer struct {
+	mu sync.Mutex
+
+	readTimer    *time.Timer
+	readCancelCh chan struct{}
+
+	writeTimer    *time.Timer
+	writeCancelCh chan struct{}
+}
+
+func (d *deadlineTimer) init() {
+	d.readCancelCh = make(chan struct{})
+	d.writeCancelCh = make(chan struct{})
+}
+
+// SetDeadline arranges for both the read and write cancel channels to be
+// closed at t. A zero t clears any pending deadline.
+func (d *deadlineTimer) SetDeadline(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.setDeadlineLocked(&d.readTimer, &d.readCancelCh, t)
+	d.setDeadlineLocked(&d.writeTimer, &d.writeCancelCh, t)
+}
+
+func (d *deadlineTimer) setDeadlineLocked(timer **time.Timer, cancelCh *chan struct{}, t time.Time) {
+	if *timer != nil && !(*timer).Stop() {
+		// The timer already fired and closed the old channel; a fresh
+		// channel is needed so the next deadline starts from scratch.
+		*cancelCh = make(chan struct{})
+	}
+
+	if t.IsZero() {
+		return
+	}
+
+	timeout := time.Until(t)
+	if timeout <= 0 {
+		close(*cancelCh)
+		return
+	}
+
+	ch := *cancelCh
+	*timer = time.AfterFunc(timeout, func() {
+		close(ch)
+	})
+}
+
+// SetRequestTimeout is a convenience wrapper that sets the deadline to timeout
+// from now, or clears it entirely when timeout is zero or negative.
+func (d *deadlineTimer) SetRequestTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		d.SetDeadline(time.Time{})
+		return
+	}
+
+	d.SetDeadline(time.Now().Add(timeout))
+}
+
+func (d *deadlineTimer) deadlineCh() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.readCancelCh
+}
+
+// Stop disarms any pending deadline. Callers use this once a request
+// completes on its own so the underlying timer doesn't stay armed in the
+// runtime's timer heap for the rest of requestTimeout.
+func (d *deadlineTimer) Stop() {
+	d.SetDeadline(time.Time{})
+}
@@ -0,0 +1,335 @@
+package workloads
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/julz/pat/config"
+)
+
+type context struct {
+	client httpclient
+
+	target       string
+	authEndpoint string
+
+	username string
+	password string
+	space    string
+
+	token        string
+	refreshToken string
+	tokenExpiry  time.Time
+	tokenSkew    time.Duration
+	refreshing   bool
+
+	requestTimeout time.Duration
+	stagingTimeout time.Duration
+
+	// transport overrides the http.Client's RoundTripper used by req; tests
+	// use this to inject a fake transport. Nil means the http.Client default.
+	transport http.RoundTripper
+
+	appSize               int
+	appCompressibilityArg string
+
+	spaceGuid string
+}
+
+const (
+	stagingInitialBackoff = 250 * time.Millisecond
+	stagingMaxBackoff     = 10 * time.Second
+	stagingMaxRetries     = 3
+)
+
+type InstanceStatus struct {
+	State string `json:"state"`
+}
+
+// cfStagingError is the shape of a Cloud Foundry error response, used to
+// tell a still-staging app (CF-NotStaged, CF-InstancesError) from a hard
+// staging failure (CF-AppStagingFailed, CF-StagingError). The HTTP status
+// line in Reply.Message doesn't carry this distinction, only the body does.
+type cfStagingError struct {
+	Code      int    `json:"code"`
+	ErrorCode string `json:"error_code"`
+}
+
+type StagingFailedError struct {
+	Reason string
+}
+
+func (e *StagingFailedError) Error() string {
+	return fmt.Sprintf("App failed to stage: %s", e.Reason)
+}
+
+type StagingTimeoutError struct {
+	Budget time.Duration
+}
+
+func (e *StagingTimeoutError) Error() string {
+	return fmt.Sprintf("App did not reach the running state within %s", e.Budget)
+}
+
+type TargetResponse struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+}
+
+type LoginResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	IdToken      string `json:"id_token"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+type Metadata struct {
+	Guid string `json:"guid"`
+}
+
+type Resource struct {
+	Metadata Metadata `json:"metadata"`
+}
+
+type SpaceResponse struct {
+	Resources []Resource `json:"resources"`
+}
+
+func NewContext(client httpclient) *context {
+	return &context{client: client, space: "dev", tokenSkew: 30 * time.Second}
+}
+
+func (context *context) DescribeParameters(config config.Config) {
+	config.StringVar(&context.target, "rest:target", "", "The API target to push apps to, e.g. http://api.my-cf.com")
+	config.StringVar(&context.username, "rest:username", "", "The username to login with")
+	config.StringVar(&context.password, "rest:password", "", "The password to login with")
+	config.StringVar(&context.space, "rest:space", "dev", "The space to push apps to")
+	config.DurationVar(&context.tokenSkew, "rest:token-skew", 30*time.Second, "How long before a UAA token's expiry to proactively refresh it")
+	config.DurationVar(&context.requestTimeout, "rest:timeout", 0, "Timeout for individual REST calls, e.g. 30s (0 disables the timeout)")
+	config.DurationVar(&context.stagingTimeout, "rest:staging-timeout", 2*time.Minute, "Total time to wait for an app to finish staging and start running")
+	config.IntVar(&context.appSize, "rest:app-size", 1024*1024, "Size in bytes of the synthetic app bits payload to push")
+	config.StringVar(&context.appCompressibilityArg, "rest:app-compressibility", "0.5", "Fraction (0-1) of the synthetic app bits payload that is trivially compressible")
+}
+
+// appCompressibility parses appCompressibilityArg, falling back to fully
+// random (incompressible) bits if the configured value isn't a valid float.
+func (context *context) appCompressibility() float64 {
+	compressibility, err := strconv.ParseFloat(context.appCompressibilityArg, 64)
+	if err != nil {
+		return 0
+	}
+
+	return compressibility
+}
+
+func (context *context) Target() error {
+	var target TargetResponse
+	return context.GetSuccessfully(context.target+"/v2/info", nil, &target, func(reply Reply) error {
+		context.authEndpoint = target.AuthorizationEndpoint
+		return nil
+	})
+}
+
+func (context *context) Login() error {
+	if context.authEndpoint == "" {
+		return errors.New("Cannot login before a successful Target")
+	}
+
+	data := url.Values{
+		"grant_type": {"password"},
+		"username":   {context.username},
+		"password":   {context.password},
+		"scope":      {""},
+	}
+
+	var login LoginResponse
+	err := context.PostToUaaSuccessfully(context.authEndpoint+"/oauth/token", data, &login, func(reply Reply) error {
+		context.storeToken(login)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var spaces SpaceResponse
+	return context.GetSuccessfully(context.target+"/v2/spaces?q=name:"+context.space, nil, &spaces, func(reply Reply) error {
+		if len(spaces.Resources) == 0 {
+			return fmt.Errorf("No such space: %s", context.space)
+		}
+
+		context.spaceGuid = spaces.Resources[0].Metadata.Guid
+		return nil
+	})
+}
+
+func (context *context) storeToken(login LoginResponse) {
+	context.token = login.AccessToken
+	context.refreshToken = login.RefreshToken
+	if login.ExpiresIn > 0 {
+		context.tokenExpiry = time.Now().Add(time.Duration(login.ExpiresIn) * time.Second)
+	} else {
+		context.tokenExpiry = time.Time{}
+	}
+}
+
+// refreshTokenIfNeeded proactively renews the access token once it's within
+// tokenSkew of expiring, falling back to a fresh password-grant Login if the
+// refresh_token grant is rejected. The refreshing guard stops that fallback
+// call to Login - which itself calls GetSuccessfully, and so re-enters
+// refreshTokenIfNeeded - from recursing forever when the token it just
+// obtained is, again, already within tokenSkew of expiring.
+func (context *context) refreshTokenIfNeeded() error {
+	if context.refreshToken == "" || context.tokenExpiry.IsZero() {
+		return nil
+	}
+
+	if time.Until(context.tokenExpiry) > context.tokenSkew {
+		return nil
+	}
+
+	if context.refreshing {
+		return nil
+	}
+	context.refreshing = true
+	defer func() { context.refreshing = false }()
+
+	data := url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {context.refreshToken},
+		"scope":         {""},
+	}
+
+	var login LoginResponse
+	err := context.PostToUaaSuccessfully(context.authEndpoint+"/oauth/token", data, &login, func(reply Reply) error {
+		context.storeToken(login)
+		return nil
+	})
+	if err == nil {
+		return nil
+	}
+
+	return context.Login()
+}
+
+func (context *context) Push() error {
+	if context.token == "" {
+		return errors.New("Cannot push before a successful Login")
+	}
+
+	appGuid := ""
+	err := context.PostSuccessfully(context.target+"/v2/apps", map[string]string{
+		"name":       randomName(),
+		"space_guid": context.spaceGuid,
+	}, nil, func(reply Reply) error {
+		appGuid = reply.Location
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	appURI := context.target + appGuid
+
+	bits := ZipBitsSource{Size: int64(context.appSize), Compressibility: context.appCompressibility()}
+	if err := context.UploadBits(appURI, bits); err != nil {
+		return err
+	}
+
+	if err := context.PutSuccessfully(appURI, map[string]string{"state": "STARTED"}, nil, func(reply Reply) error {
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	return context.waitForStaging(appURI)
+}
+
+// waitForStaging polls appURI/instances until every instance reports RUNNING,
+// the app fails to stage, or the staging-timeout budget is exhausted.
+//
+// CF-NotStaged and CF-InstancesError mean the app simply isn't ready to
+// report instance state yet, so they're retried, but only up to
+// stagingMaxRetries times; any other non-2xx reply (including
+// CF-AppStagingFailed/CF-StagingError) is treated as a hard failure.
+func (context *context) waitForStaging(appURI string) error {
+	backoff := stagingInitialBackoff
+	deadline := time.Now().Add(context.stagingTimeout)
+	retries := 0
+
+	for {
+		// Staging failures are reported as a non-2xx Reply, so this can't go
+		// through GetSuccessfully: its callback only fires on success, and
+		// we need the body either way to tell a still-staging app from a
+		// hard staging failure.
+		if err := context.refreshTokenIfNeeded(); err != nil {
+			return err
+		}
+
+		var raw json.RawMessage
+		reply := context.client.Get(appURI+"/instances", nil, &raw)
+
+		if reply.Code >= 200 && reply.Code < 300 {
+			var instances map[string]InstanceStatus
+			if err := json.Unmarshal(raw, &instances); err == nil && allInstancesRunning(instances) {
+				return nil
+			}
+		} else {
+			var cfErr cfStagingError
+			json.Unmarshal(raw, &cfErr)
+
+			if !isRetryableStagingError(cfErr) {
+				return &StagingFailedError{Reason: cfErr.ErrorCode}
+			}
+
+			retries++
+			if retries > stagingMaxRetries {
+				return &StagingFailedError{Reason: cfErr.ErrorCode}
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return &StagingTimeoutError{Budget: context.stagingTimeout}
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > stagingMaxBackoff {
+			backoff = stagingMaxBackoff
+		}
+	}
+}
+
+func isRetryableStagingError(cfErr cfStagingError) bool {
+	return cfErr.ErrorCode == "CF-NotStaged" || cfErr.ErrorCode == "CF-InstancesError"
+}
+
+func allInstancesRunning(instances map[string]InstanceStatus) bool {
+	if len(instances) == 0 {
+		return false
+	}
+
+	for _, instance := range instances {
+		if instance.State != "RUNNING" {
+			return false
+		}
+	}
+
+	return true
+}
+
+func checkSuccessfulReply(reply Reply, fn func() error) error {
+	if reply.Code < 200 || reply.Code >= 300 {
+		return fmt.Errorf("Request failed: %d %s", reply.Code, reply.Message)
+	}
+
+	return fn()
+}
+
+func randomName() string {
+	return fmt.Sprintf("pat-app-%d", rand.Int63())
+}
@@ -3,7 +3,8 @@ package workloads_test
 import (
 	"bytes"
 	"encoding/json"
-	"mime/multipart"
+	"io"
+	"io/ioutil"
 	"net/url"
 
 	"github.com/julz/pat/config"
@@ -31,7 +32,7 @@ var _ = Describe("Rest Workloads", func() {
 	BeforeEach(func() {
 		replies = make(map[string]interface{})
 		replyWithLocation = make(map[string]string)
-		client = &dummyClient{replies, replyWithLocation, make(map[call]interface{})}
+		client = &dummyClient{replies: replies, replyWithLocation: replyWithLocation, calls: make(map[call]interface{})}
 		ctx = NewContext(client)
 		config := config.NewConfig()
 		ctx.DescribeParameters(config)
@@ -51,7 +52,7 @@ var _ = Describe("Rest Workloads", func() {
 
 		Context("After logging in", func() {
 			BeforeEach(func() {
-				replies["THELOGINSERVER/PATH/oauth/token"] = LoginResponse{"blah blah"}
+				replies["THELOGINSERVER/PATH/oauth/token"] = LoginResponse{AccessToken: "blah blah"}
 
 				spaceReply := SpaceResponse{[]Resource{Resource{Metadata{"blah blah"}}}}
 				replies["APISERVER/v2/spaces?q=name:dev"] = spaceReply
@@ -59,6 +60,7 @@ var _ = Describe("Rest Workloads", func() {
 				replyWithLocation["APISERVER/v2/apps"] = "/THE-APP-URI"
 				replies["APISERVER/THE-APP-URI"] = ""
 				replies["APISERVER/THE-APP-URI/bits"] = ""
+				replies["APISERVER/THE-APP-URI/instances"] = map[string]InstanceStatus{"0": {State: "RUNNING"}}
 
 				err := ctx.Target()
 				Ω(err).ShouldNot(HaveOccurred())
@@ -80,10 +82,10 @@ var _ = Describe("Rest Workloads", func() {
 				Ω(m["space_guid"]).Should(Equal("blah blah"))
 			})
 
-			It("Uploads app bits", func() {
+			It("Streams the app's bits as a multipart upload", func() {
 				ctx.Push()
-				data := client.ShouldHaveBeenCalledWith("PUT(multipart)", "APISERVER/THE-APP-URI/bits")
-				Ω(data).ShouldNot(BeNil())
+				streamed := client.ShouldHaveBeenCalledWith("PUT(multipart)", "APISERVER/THE-APP-URI/bits")
+				Ω(streamed).Should(BeNumerically(">", 0))
 			})
 
 			It("Starts the app", func() {
@@ -94,14 +96,65 @@ var _ = Describe("Rest Workloads", func() {
 
 			Context("When the app starts immediately", func() {
 				It("Doesn't return any error", func() {
-					replies["APISERVER/THE-APP-URI/instances"] = "foo" // return a 200
+					replies["APISERVER/THE-APP-URI/instances"] = map[string]InstanceStatus{"0": {State: "RUNNING"}}
 					err := ctx.Push()
 					Ω(err).ShouldNot(HaveOccurred())
 				})
 			})
 
 			Context("When the app status eventually returns CF-NotStaged", func() {
-				PIt("Returns an error", func() {
+				BeforeEach(func() {
+					client.QueueReplies("GET", "APISERVER/THE-APP-URI/instances",
+						Reply{Code: 400, Message: "CF-NotStaged"},
+						Reply{Code: 400, Message: "CF-NotStaged"},
+						Reply{Code: 400, Message: "CF-AppStagingFailed"},
+					)
+				})
+
+				It("Returns an error", func() {
+					err := ctx.Push()
+					Ω(err).Should(HaveOccurred())
+				})
+			})
+
+			Context("When the app keeps reporting CF-InstancesError beyond the retry budget", func() {
+				BeforeEach(func() {
+					client.QueueReplies("GET", "APISERVER/THE-APP-URI/instances",
+						Reply{Code: 400, Message: "CF-InstancesError"},
+						Reply{Code: 400, Message: "CF-InstancesError"},
+						Reply{Code: 400, Message: "CF-InstancesError"},
+						Reply{Code: 400, Message: "CF-InstancesError"},
+					)
+				})
+
+				It("Gives up instead of polling forever", func() {
+					err := ctx.Push()
+					Ω(err).Should(HaveOccurred())
+				})
+			})
+
+			Context("When the access token is about to expire", func() {
+				BeforeEach(func() {
+					replies["THELOGINSERVER/PATH/oauth/token"] = LoginResponse{AccessToken: "blah blah", RefreshToken: "the-refresh-token", ExpiresIn: 1}
+					ctx.Login()
+				})
+
+				It("Refreshes the token via the refresh_token grant before pushing", func() {
+					ctx.Push()
+					data := client.ShouldHaveBeenCalledWith("POST(uaa)", "THELOGINSERVER/PATH/oauth/token")
+					Ω(data.(url.Values)["grant_type"]).Should(Equal([]string{"refresh_token"}))
+					Ω(data.(url.Values)["refresh_token"]).Should(Equal([]string{"the-refresh-token"}))
+				})
+
+				Context("And both the refresh grant and the password-grant fallback fail", func() {
+					BeforeEach(func() {
+						replies["THELOGINSERVER/PATH/oauth/token"] = nil
+					})
+
+					It("Surfaces the error instead of pushing with a stale token", func() {
+						err := ctx.Push()
+						Ω(err).Should(HaveOccurred())
+					})
 				})
 			})
 		})
@@ -187,7 +240,7 @@ var _ = Describe("Rest Workloads", func() {
 		Describe("When the API hasn't been targetted yet", func() {
 			It("Will return an error", func() {
 				err := ctx.Login()
-				Ω(err).To(HaveOccured())
+				Ω(err).To(HaveOccurred())
 			})
 		})
 	})
@@ -197,6 +250,7 @@ type dummyClient struct {
 	replies           map[string]interface{}
 	replyWithLocation map[string]string
 	calls             map[call]interface{}
+	queuedReplies     map[call][]Reply
 }
 
 type call struct {
@@ -209,25 +263,55 @@ func (d *dummyClient) ShouldHaveBeenCalledWith(method string, path string) inter
 	return d.calls[call{method, path}]
 }
 
+// QueueReplies makes successive calls to method/path return each reply in
+// turn, so a test can assert on a specific retry/backoff sequence rather than
+// a single static response.
+func (d *dummyClient) QueueReplies(method string, path string, replies ...Reply) {
+	if d.queuedReplies == nil {
+		d.queuedReplies = make(map[call][]Reply)
+	}
+	d.queuedReplies[call{method, path}] = replies
+}
+
 func (d *dummyClient) Req(method string, host string, data interface{}, s interface{}) (reply Reply) {
 	d.calls[call{method, host}] = data
+
+	if queued := d.queuedReplies[call{method, host}]; len(queued) > 0 {
+		next := queued[0]
+		d.queuedReplies[call{method, host}] = queued[1:]
+
+		if next.Code < 200 || next.Code >= 300 {
+			// Queued error replies carry their CF error_code in Message for
+			// the test's convenience; encode it the way a real CF error body
+			// would, since production code now parses the body, not Message.
+			body, _ := json.Marshal(map[string]interface{}{"code": next.Code, "error_code": next.Message})
+			json.NewDecoder(bytes.NewReader(body)).Decode(s)
+		}
+
+		return next
+	}
+
 	if d.replyWithLocation[host] != "" {
-		return Reply{201, "Moved", d.replyWithLocation[host]}
+		return Reply{Code: 201, Message: "Moved", Location: d.replyWithLocation[host]}
 	}
 	if d.replies[host] == nil {
-		return Reply{400, "Some error", ""}
+		return Reply{Code: 400, Message: "Some error"}
 	}
 	b, _ := json.Marshal(d.replies[host])
 	json.NewDecoder(bytes.NewReader(b)).Decode(s)
-	return Reply{200, "Success", ""}
+	return Reply{Code: 200, Message: "Success"}
 }
 
 func (d *dummyClient) Get(host string, data interface{}, s interface{}) (reply Reply) {
 	return d.Req("GET", host, data, s)
 }
 
-func (d *dummyClient) MultipartPut(m *multipart.Writer, host string, data interface{}, s interface{}) (reply Reply) {
-	return d.Req("PUT(multipart)", host, data, s)
+// MultipartPut drains body and records the number of bytes actually streamed,
+// rather than the io.Reader itself (which ShouldHaveBeenCalledWith can't
+// usefully compare). contentLength is not checked against that count.
+func (d *dummyClient) MultipartPut(host string, contentType string, contentLength int64, body io.Reader, s interface{}) (reply Reply) {
+	streamed, _ := io.Copy(ioutil.Discard, body)
+	return d.Req("PUT(multipart)", host, streamed, s)
 }
 
 func (d *dummyClient) Put(host string, data interface{}, s interface{}) (reply Reply) {
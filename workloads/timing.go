@@ -0,0 +1,94 @@
+package workloads
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+// Timings captures how long each phase of a single REST call took, so a
+// slow push can be attributed to DNS, connection setup, TLS or the server
+// itself rather than shown as one opaque total.
+type Timings struct {
+	DNS     time.Duration
+	Connect time.Duration
+	TLS     time.Duration
+	TTFB    time.Duration
+	Total   time.Duration
+}
+
+// MetricsSink, when set, receives the Metrics() of every completed REST
+// call's Timings. This snapshot has no sample/store package of its own for
+// per-operation metrics to flow into, so wiring Timings all the way into the
+// CSV/store output isn't possible here; MetricsSink is the extension point
+// a pat worker assigns to pick them up once that package exists.
+var MetricsSink func(map[string]float64)
+
+// Metrics renders Timings as the dns_ms/connect_ms/tls_ms/ttfb_ms/total_ms
+// samples a pat worker attaches alongside its other per-operation metrics.
+func (t Timings) Metrics() map[string]float64 {
+	return map[string]float64{
+		"dns_ms":     durationMillis(t.DNS),
+		"connect_ms": durationMillis(t.Connect),
+		"tls_ms":     durationMillis(t.TLS),
+		"ttfb_ms":    durationMillis(t.TTFB),
+		"total_ms":   durationMillis(t.Total),
+	}
+}
+
+func durationMillis(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// newClientTrace returns an httptrace.ClientTrace that records the
+// wall-clock time of each phase into timings as the phases complete.
+// start is the instant the request began, used to measure TTFB.
+func newClientTrace(start time.Time, timings *Timings) *httptrace.ClientTrace {
+	var mu sync.Mutex
+	var dnsStart, connectStart, tlsStart time.Time
+
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			mu.Lock()
+			dnsStart = time.Now()
+			mu.Unlock()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !dnsStart.IsZero() {
+				timings.DNS = time.Since(dnsStart)
+			}
+		},
+		ConnectStart: func(network, addr string) {
+			mu.Lock()
+			connectStart = time.Now()
+			mu.Unlock()
+		},
+		ConnectDone: func(network, addr string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !connectStart.IsZero() {
+				timings.Connect = time.Since(connectStart)
+			}
+		},
+		TLSHandshakeStart: func() {
+			mu.Lock()
+			tlsStart = time.Now()
+			mu.Unlock()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if !tlsStart.IsZero() {
+				timings.TLS = time.Since(tlsStart)
+			}
+		},
+		GotFirstResponseByte: func() {
+			mu.Lock()
+			defer mu.Unlock()
+			timings.TTFB = time.Since(start)
+		},
+	}
+}